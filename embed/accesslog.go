@@ -0,0 +1,268 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// AccessLogConfig configures the structured access log written for every
+// gRPC RPC and gateway HTTP request.
+type AccessLogConfig struct {
+	// Path is the destination for access log records, one JSON object per
+	// line. "" disables access logging; "-" writes to stderr.
+	Path string
+	// MaxSizeMB, MaxBackups, and MaxAgeDays control log rotation when Path
+	// is a regular file; see lumberjack.Logger for defaults.
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+	// SampleRate is the fraction of requests logged, in (0,1]. Defaults
+	// to 1 (log everything).
+	SampleRate float64
+	// RedactBytes truncates the logged method field (for HTTP requests,
+	// the HTTP method and request path) beyond this length, so a single
+	// oversized path doesn't bloat the log. 0 disables truncation.
+	RedactBytes int
+}
+
+// accessLogRecord is one structured access log line.
+type accessLogRecord struct {
+	Time       time.Time `json:"time"`
+	TraceID    string    `json:"trace_id"`
+	Proto      string    `json:"proto"` // "grpc" or "http"
+	Method     string    `json:"method"`
+	Peer       string    `json:"peer"`
+	Status     string    `json:"status"`
+	DurationMS float64   `json:"duration_ms"`
+	ReqBytes   int64     `json:"req_bytes,omitempty"`
+	RespBytes  int64     `json:"resp_bytes,omitempty"`
+}
+
+type accessLogger struct {
+	cfg AccessLogConfig
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func newAccessLogger(cfg AccessLogConfig) *accessLogger {
+	al := &accessLogger{cfg: cfg}
+	switch cfg.Path {
+	case "":
+		al.out = nil
+	case "-":
+		al.out = os.Stderr
+	default:
+		al.out = &lumberjack.Logger{
+			Filename:   cfg.Path,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+		}
+	}
+	return al
+}
+
+func (al *accessLogger) enabled() bool { return al != nil && al.out != nil }
+
+func (al *accessLogger) sampled() bool {
+	rate := al.cfg.SampleRate
+	if rate <= 0 {
+		rate = 1
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+func (al *accessLogger) redact(s string) string {
+	if al.cfg.RedactBytes > 0 && len(s) > al.cfg.RedactBytes {
+		return s[:al.cfg.RedactBytes] + "...(redacted)"
+	}
+	return s
+}
+
+func (al *accessLogger) write(rec accessLogRecord) {
+	if !al.enabled() || !al.sampled() {
+		return
+	}
+	rec.Method = al.redact(rec.Method)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	al.mu.Lock()
+	al.out.Write(line)
+	al.mu.Unlock()
+}
+
+func (al *accessLogger) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !al.enabled() {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	al.write(accessLogRecord{
+		Time:       start,
+		TraceID:    uuid.New(),
+		Proto:      "grpc",
+		Method:     info.FullMethod,
+		Peer:       identityFromContext(ctx),
+		Status:     status.Code(err).String(),
+		DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+	return resp, err
+}
+
+func (al *accessLogger) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !al.enabled() {
+		return handler(srv, ss)
+	}
+	start := time.Now()
+	err := handler(srv, ss)
+	al.write(accessLogRecord{
+		Time:       start,
+		TraceID:    uuid.New(),
+		Proto:      "grpc",
+		Method:     info.FullMethod,
+		Peer:       identityFromContext(ss.Context()),
+		Status:     status.Code(err).String(),
+		DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+	return err
+}
+
+// httpAccessLog wraps h, recording an access log line and gatewayDuration/
+// gatewayTotal metrics for every request it serves.
+func (al *accessLogger) httpAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		d := time.Since(start)
+
+		observeGateway(r.URL.Path, rec.status, d)
+		bytesOut.WithLabelValues("gateway").Add(float64(rec.bytes))
+		bytesIn.WithLabelValues("gateway").Add(float64(r.ContentLength))
+
+		if al.enabled() {
+			al.write(accessLogRecord{
+				Time:       start,
+				TraceID:    r.Header.Get("X-Request-Id"),
+				Proto:      "http",
+				Method:     r.Method + " " + al.redact(r.URL.Path),
+				Peer:       httpPeerIdentity(r),
+				Status:     http.StatusText(rec.status),
+				DurationMS: float64(d) / float64(time.Millisecond),
+				ReqBytes:   r.ContentLength,
+				RespBytes:  rec.bytes,
+			})
+		}
+	})
+}
+
+// httpPeerIdentity returns the CN of r's client certificate, mirroring
+// AuthHook.extract's gRPC-side identity resolution for the gateway's HTTP
+// requests. identityFromContext doesn't apply here: the gateway's outgoing
+// gRPC call (not the raw incoming *http.Request) is what travels through
+// the interceptor chain that sets it, so the identity injected there never
+// reaches r.Context().
+func httpPeerIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// countingResponseWriter counts response bytes for the gateway byte
+// metrics. It forwards Hijack/Flush/CloseNotify to the underlying
+// ResponseWriter when present, rather than just embedding it, so
+// wrapping a streaming handler (wsproxy's websocket upgrade for Watch)
+// in httpAccessLog doesn't silently strip the interfaces that upgrade
+// needs -- the same trap fieldMaskFilter's own buffering writer avoids
+// by not wrapping streaming requests at all (see gateway.go).
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("embed: ResponseWriter %T does not support Hijack", w.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	ch := make(chan bool)
+	return ch
+}
+
+// grpcByteStatsHandler feeds bytesIn/bytesOut from the wire-level payload
+// sizes grpc-go already tracks per RPC, labeled "grpc".
+type grpcByteStatsHandler struct{}
+
+func (grpcByteStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+func (grpcByteStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+func (grpcByteStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+func (grpcByteStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	switch v := s.(type) {
+	case *stats.InPayload:
+		bytesIn.WithLabelValues("grpc").Add(float64(v.WireLength))
+	case *stats.OutPayload:
+		bytesOut.WithLabelValues("grpc").Add(float64(v.WireLength))
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// TestAccessLogCapturesAuthenticatedPeer verifies that, in the gRPC
+// interceptor chain, the access-log interceptor receives the context
+// carrying the peer identity AuthHook injects, provided the auth
+// interceptor runs first (as interceptorOpts arranges). The handler after
+// it sees the same context. The HTTP/gateway path is covered by
+// TestHTTPPeerIdentityReadsClientCert.
+func TestAccessLogCapturesAuthenticatedPeer(t *testing.T) {
+	al := &accessLogger{cfg: AccessLogConfig{Path: "-"}, out: &discardWriter{}}
+
+	auth := &AuthHook{Extract: func(ctx context.Context) (string, error) { return "alice", nil }}
+	chained := chainUnaryInterceptors([]grpc.UnaryServerInterceptor{auth.unaryInterceptor, al.unaryInterceptor})
+
+	var gotPeer string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		gotPeer = identityFromContext(ctx)
+		return nil, nil
+	}
+	_, err := chained(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test"}, handler)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotPeer != "alice" {
+		t.Fatalf("expected the handler (and thus the access-log interceptor running after auth) to observe identity %q, got %q", "alice", gotPeer)
+	}
+}
+
+// TestHTTPPeerIdentityReadsClientCert verifies that the gateway's HTTP
+// access-log path resolves the peer identity from the request's TLS
+// client certificate rather than an always-empty request context.
+func TestHTTPPeerIdentityReadsClientCert(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v3beta/kv/range", nil)
+	if got := httpPeerIdentity(req); got != "" {
+		t.Fatalf("expected no identity for a plaintext request, got %q", got)
+	}
+
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "bob"}}},
+	}
+	if got := httpPeerIdentity(req); got != "bob" {
+		t.Fatalf("expected identity %q from the client certificate, got %q", "bob", got)
+	}
+}
+
+// TestHTTPAccessLogPassesThroughHijack verifies that httpAccessLog's
+// countingResponseWriter still lets a streaming handler (e.g. wsproxy's
+// websocket upgrade for Watch) hijack the underlying connection, rather
+// than silently hiding the http.Hijacker the real ResponseWriter
+// implements.
+func TestHTTPAccessLogPassesThroughHijack(t *testing.T) {
+	al := newAccessLogger(AccessLogConfig{})
+
+	hijacked := false
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatalf("expected the wrapped ResponseWriter to implement http.Hijacker")
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Fatalf("Hijack: %v", err)
+		}
+		hijacked = true
+		conn.Close()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v3beta/watch", nil)
+	al.httpAccessLog(inner).ServeHTTP(&hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}, req)
+
+	if !hijacked {
+		t.Fatalf("expected the handler to successfully hijack the connection")
+	}
+}
+
+// hijackableRecorder adds a working http.Hijacker to httptest.ResponseRecorder,
+// which doesn't implement one, so tests can exercise handlers that upgrade
+// the connection (as wsproxy does for Watch).
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	server, client := net.Pipe()
+	go client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
@@ -0,0 +1,75 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import "google.golang.org/grpc"
+
+// Config exposes the client-serving knobs added on top of serveCtx --
+// middleware, the gateway, gRPC-Web/Connect CORS, extra cmux matchers,
+// custom listener construction, TLS management, and access logging -- so an
+// embedder can reach them without depending on the unexported serveCtx they
+// ultimately configure. A zero Config (or a nil *Config) keeps every knob at
+// its default, inert value.
+type Config struct {
+	// Middleware bundles the optional gRPC interceptors (auth, rate
+	// limiting, tracing) installed ahead of UnaryInterceptors/
+	// StreamInterceptors. See Middleware.
+	Middleware *Middleware
+	// UnaryInterceptors and StreamInterceptors run, in order, after
+	// Middleware's interceptors.
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+
+	// GatewayOptions configures the HTTP/JSON gateway mux.
+	GatewayOptions GatewayOptions
+
+	// CORS configures preflight handling for the gRPC-Web/Connect
+	// endpoints exposed alongside the native gRPC and gateway ones.
+	CORS CORSOptions
+
+	// Matchers are tried, in order, ahead of cmux's built-in HTTP2/HTTP1/
+	// Any matchers, so embedders can layer extra protocols onto the
+	// client listener. See MatchHandler.
+	Matchers []MatchHandler
+
+	// ListenerFactory, when set, is consulted by NewClientListener before
+	// falling back to etcd's own TCP/Unix/systemd listener construction.
+	ListenerFactory ListenerFactory
+
+	// TLS configures SNI-based multi-cert serving, on-disk cert reload,
+	// and ACME issuance for the secure listener.
+	TLS TLSManagerConfig
+
+	// AccessLog configures the structured access log and byte-count
+	// metrics emitted for every gRPC RPC and gateway HTTP request.
+	AccessLog AccessLogConfig
+}
+
+// apply copies cfg's fields onto sctx. cfg may be nil, in which case sctx is
+// left unchanged.
+func (cfg *Config) apply(sctx *serveCtx) {
+	if cfg == nil {
+		return
+	}
+	sctx.Mw = cfg.Middleware
+	sctx.UnaryInterceptors = cfg.UnaryInterceptors
+	sctx.StreamInterceptors = cfg.StreamInterceptors
+	sctx.GatewayOptions = cfg.GatewayOptions
+	sctx.CORS = cfg.CORS
+	sctx.Matchers = cfg.Matchers
+	sctx.ListenerFactory = cfg.ListenerFactory
+	sctx.TLS = cfg.TLS
+	sctx.AccessLog = cfg.AccessLog
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import "testing"
+
+// TestConfigApplyCopiesFields verifies that newServeCtx's serveCtx actually
+// carries the knobs set on an exported Config, so embedders configuring
+// Config (rather than poking at serveCtx directly, which they can't reach)
+// see them take effect.
+func TestConfigApplyCopiesFields(t *testing.T) {
+	mw := &Middleware{}
+	cfg := &Config{
+		Middleware: mw,
+		CORS:       CORSOptions{AllowedOrigins: []string{"https://example.com"}},
+		AccessLog:  AccessLogConfig{Path: "-"},
+	}
+
+	sctx := newServeCtx(cfg)
+
+	if sctx.Mw != mw {
+		t.Fatalf("expected sctx.Mw to be cfg.Middleware")
+	}
+	if len(sctx.CORS.AllowedOrigins) != 1 || sctx.CORS.AllowedOrigins[0] != "https://example.com" {
+		t.Fatalf("expected sctx.CORS to carry cfg.CORS, got %+v", sctx.CORS)
+	}
+	if sctx.AccessLog.Path != "-" {
+		t.Fatalf("expected sctx.AccessLog to carry cfg.AccessLog, got %+v", sctx.AccessLog)
+	}
+}
+
+// TestConfigApplyNilLeavesDefaults verifies that a nil *Config (the zero
+// value for an embedder who doesn't set one) doesn't panic and leaves
+// sctx.Mw at its nil default.
+func TestConfigApplyNilLeavesDefaults(t *testing.T) {
+	sctx := newServeCtx(nil)
+	if sctx.Mw != nil {
+		t.Fatalf("expected sctx.Mw to be nil, got %+v", sctx.Mw)
+	}
+}
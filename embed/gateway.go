@@ -0,0 +1,278 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	gw "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"gopkg.in/yaml.v2"
+)
+
+// GatewayOptions configures the HTTP/JSON gateway mux created in
+// serveCtx.registerGateway.
+type GatewayOptions struct {
+	// Mux carries extra gw.ServeMuxOption values (e.g. header matchers,
+	// additional marshalers) appended after etcd's defaults.
+	Mux []gw.ServeMuxOption
+	// OrigName, when true, emits JSON field names exactly as they
+	// appear in the .proto file instead of lowerCamelCase.
+	OrigName bool
+}
+
+// defaultGatewayMuxOptions returns the ServeMuxOptions etcd always installs:
+// a JSONPb marshaler (the default and explicit application/json), a raw
+// protobuf marshaler for application/x-protobuf, and a YAML marshaler for
+// application/yaml. opts.Mux is appended last so callers can override any
+// of these per content-type.
+func defaultGatewayMuxOptions(opts GatewayOptions) []gw.ServeMuxOption {
+	jsonpbMarshaler := &gw.JSONPb{OrigName: opts.OrigName, EmitDefaults: true}
+	muxOpts := []gw.ServeMuxOption{
+		gw.WithMarshalerOption(gw.MIMEWildcard, jsonpbMarshaler),
+		gw.WithMarshalerOption("application/json", jsonpbMarshaler),
+		gw.WithMarshalerOption("application/x-protobuf", &protoMarshaler{}),
+		gw.WithMarshalerOption("application/yaml", &yamlMarshaler{jsonpb: jsonpbMarshaler}),
+	}
+	return append(muxOpts, opts.Mux...)
+}
+
+// protoMarshaler marshals responses as raw protobuf, so REST clients can
+// request application/x-protobuf for the same bytes a native gRPC call
+// would return.
+type protoMarshaler struct{}
+
+func (*protoMarshaler) ContentType() string { return "application/x-protobuf" }
+
+func (*protoMarshaler) Marshal(v interface{}) ([]byte, error) {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Marshal(pm)
+}
+
+func (*protoMarshaler) Unmarshal(data []byte, v interface{}) error {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, pm)
+}
+
+func (m *protoMarshaler) NewDecoder(r io.Reader) gw.Decoder {
+	return gw.DecoderFunc(func(v interface{}) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return m.Unmarshal(data, v)
+	})
+}
+
+func (m *protoMarshaler) NewEncoder(w io.Writer) gw.Encoder {
+	return gw.EncoderFunc(func(v interface{}) error {
+		data, err := m.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+}
+
+// yamlMarshaler re-encodes the JSONPb representation of a message as YAML
+// for clients that request application/yaml.
+type yamlMarshaler struct {
+	jsonpb *gw.JSONPb
+}
+
+func (*yamlMarshaler) ContentType() string { return "application/yaml" }
+
+func (m *yamlMarshaler) Marshal(v interface{}) ([]byte, error) {
+	js, err := m.jsonpb.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(js, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+func (m *yamlMarshaler) Unmarshal(data []byte, v interface{}) error {
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	js, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return m.jsonpb.Unmarshal(js, v)
+}
+
+func (m *yamlMarshaler) NewDecoder(r io.Reader) gw.Decoder {
+	return gw.DecoderFunc(func(v interface{}) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return m.Unmarshal(data, v)
+	})
+}
+
+func (m *yamlMarshaler) NewEncoder(w io.Writer) gw.Encoder {
+	return gw.EncoderFunc(func(v interface{}) error {
+		data, err := m.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+}
+
+// fieldMaskFilter wraps h so that a "fields" query parameter or X-Fields
+// header (e.g. "kvs.key,kvs.value") trims a JSON response down to the
+// listed dotted field paths before it reaches the client. This lets REST
+// consumers of large KV/Range responses cut down on payload size. The
+// response is still computed and serialized in full; the filter decodes
+// that JSON, trims it, and re-encodes it.
+//
+// It only applies to single, fully-buffered JSON responses. A Watch
+// stream's ServeHTTP never returns for the life of the connection, and the
+// websocket upgrade wsproxy performs for it needs http.Hijacker, which the
+// buffering ResponseWriter below does not implement -- so streaming and
+// websocket-upgraded requests are passed through untouched.
+func fieldMaskFilter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := r.URL.Query().Get("fields")
+		if fields == "" {
+			fields = r.Header.Get("X-Fields")
+		}
+		if fields == "" || isStreamingGatewayRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &bufferingResponseWriter{header: http.Header{}, buf: &bytes.Buffer{}, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		if !strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") {
+			w.WriteHeader(rec.status)
+			w.Write(rec.buf.Bytes())
+			return
+		}
+
+		var body interface{}
+		if err := json.Unmarshal(rec.buf.Bytes(), &body); err != nil {
+			w.WriteHeader(rec.status)
+			w.Write(rec.buf.Bytes())
+			return
+		}
+		filtered := applyFieldMask(body, strings.Split(fields, ","))
+		out, err := json.Marshal(filtered)
+		if err != nil {
+			w.WriteHeader(rec.status)
+			w.Write(rec.buf.Bytes())
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+		w.WriteHeader(rec.status)
+		w.Write(out)
+	})
+}
+
+// isStreamingGatewayRequest reports whether r targets a streaming gateway
+// endpoint -- a websocket upgrade (how wsproxy serves Watch) or the Watch
+// path itself -- that fieldMaskFilter must not buffer.
+func isStreamingGatewayRequest(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	return strings.Contains(strings.ToLower(r.URL.Path), "/watch")
+}
+
+// applyFieldMask projects body down to the dotted paths in mask. Non-object
+// values and unmatched paths are left untouched; this mirrors protobuf
+// field-mask semantics closely enough for response filtering without
+// depending on the generated message types here.
+func applyFieldMask(body interface{}, mask []string) interface{} {
+	tree := make(map[string]interface{})
+	for _, path := range mask {
+		insertPath(tree, strings.Split(strings.TrimSpace(path), "."))
+	}
+	return projectFields(body, tree)
+}
+
+func insertPath(tree map[string]interface{}, parts []string) {
+	if len(parts) == 0 || parts[0] == "" {
+		return
+	}
+	child, ok := tree[parts[0]].(map[string]interface{})
+	if !ok {
+		child = make(map[string]interface{})
+		tree[parts[0]] = child
+	}
+	insertPath(child, parts[1:])
+}
+
+func projectFields(v interface{}, tree map[string]interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(tree))
+		for k, sub := range tree {
+			child, ok := val[k]
+			if !ok {
+				continue
+			}
+			if subtree, ok := sub.(map[string]interface{}); ok && len(subtree) > 0 {
+				out[k] = projectFields(child, subtree)
+			} else {
+				out[k] = child
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = projectFields(item, tree)
+		}
+		return out
+	default:
+		return val
+	}
+}
+
+type bufferingResponseWriter struct {
+	header http.Header
+	buf    *bytes.Buffer
+	status int
+}
+
+func (w *bufferingResponseWriter) Header() http.Header { return w.header }
+func (w *bufferingResponseWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *bufferingResponseWriter) WriteHeader(status int)       { w.status = status }
@@ -0,0 +1,67 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestFieldMaskFilterProjectsJSON verifies that a "fields" query parameter
+// trims a buffered JSON response down to the requested dotted paths.
+func TestFieldMaskFilterProjectsJSON(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kvs":[{"key":"a","value":"b","create_revision":1}],"count":1}`))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v3beta/kv/range?fields=kvs.key,count", nil)
+	rec := httptest.NewRecorder()
+	fieldMaskFilter(inner).ServeHTTP(rec, req)
+
+	got := rec.Body.String()
+	for _, want := range []string{`"key":"a"`, `"count":1`} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected filtered body to contain %q, got %s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"value", "create_revision"} {
+		if strings.Contains(got, unwanted) {
+			t.Fatalf("expected filtered body to omit %q, got %s", unwanted, got)
+		}
+	}
+}
+
+// TestFieldMaskFilterSkipsStreamingRequests verifies that fieldMaskFilter
+// passes a Watch/websocket request straight through to the handler, rather
+// than buffering its (never-ending) response, even when "fields" is set.
+func TestFieldMaskFilterSkipsStreamingRequests(t *testing.T) {
+	var gotWriter http.ResponseWriter
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotWriter = w
+	})
+
+	outer := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v3beta/watch?fields=kvs.key", nil)
+	req.Header.Set("Upgrade", "websocket")
+
+	fieldMaskFilter(inner).ServeHTTP(outer, req)
+
+	if gotWriter != http.ResponseWriter(outer) {
+		t.Fatalf("expected the streaming handler to receive the original ResponseWriter unwrapped, got %T", gotWriter)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+)
+
+// CORSOptions configures the CORS preflight handling applied in front of
+// the gRPC-Web/Connect endpoints, so browser SPAs can call etcd directly
+// without an envoy/grpcwebproxy sidecar in front.
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+func (c CORSOptions) originAllowed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHandler wraps h with CORS preflight handling for the allowed origins
+// in cors. Requests from origins that are not allowed fall through to h
+// unmodified, since CORS is enforced by the browser, not the server.
+func corsHandler(cors CORSOptions, h http.Handler) http.Handler {
+	if len(cors.AllowedOrigins) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && cors.originAllowed(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+			if cors.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(cors.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			}
+		}
+		if allowed && r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newGRPCWebWrapper wraps gs so that browsers and proxies speaking
+// gRPC-Web can call it over HTTP/1.1 or HTTP/2 without an external
+// translating proxy. The wrapper translates gRPC-Web only; it does not
+// implement the Connect protocol, so Connect requests routed to it are
+// not translated into gRPC calls.
+func newGRPCWebWrapper(gs *grpc.Server, cors CORSOptions) *grpcweb.WrappedGrpcServer {
+	opts := []grpcweb.Option{
+		grpcweb.WithOriginFunc(func(origin string) bool { return cors.originAllowed(origin) }),
+	}
+	if len(cors.AllowedHeaders) > 0 {
+		opts = append(opts, grpcweb.WithAllowedRequestHeaders(cors.AllowedHeaders))
+	}
+	return grpcweb.WrapServer(gs, opts...)
+}
+
+// isGRPCWebOrConnect reports whether r targets the gRPC-Web or Connect
+// protocols rather than standard gRPC (application/grpc) or the REST
+// gateway.
+func isGRPCWebOrConnect(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	for _, prefix := range []string{
+		"application/grpc-web",
+		"application/connect+proto",
+		"application/connect+json",
+	} {
+		if strings.HasPrefix(ct, prefix) {
+			return true
+		}
+	}
+	return false
+}
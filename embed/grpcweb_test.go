@@ -0,0 +1,83 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsGRPCWebOrConnect(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc-web", true},
+		{"application/grpc-web+proto", true},
+		{"application/grpc-web-text", true},
+		{"application/connect+proto", true},
+		{"application/connect+json", true},
+		{"application/grpc", false},
+		{"application/json", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Content-Type", tt.contentType)
+		if got := isGRPCWebOrConnect(req); got != tt.want {
+			t.Errorf("isGRPCWebOrConnect(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestCORSOptionsOriginAllowed(t *testing.T) {
+	cors := CORSOptions{AllowedOrigins: []string{"https://example.com"}}
+	if !cors.originAllowed("https://example.com") {
+		t.Fatalf("expected configured origin to be allowed")
+	}
+	if cors.originAllowed("https://evil.example") {
+		t.Fatalf("expected unconfigured origin to be rejected")
+	}
+
+	wildcard := CORSOptions{AllowedOrigins: []string{"*"}}
+	if !wildcard.originAllowed("https://anything.example") {
+		t.Fatalf("expected wildcard to allow any origin")
+	}
+}
+
+func TestCORSHandlerPreflight(t *testing.T) {
+	cors := CORSOptions{AllowedOrigins: []string{"https://example.com"}, AllowCredentials: true}
+	called := false
+	h := corsHandler(cors, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if called {
+		t.Fatalf("expected a preflight OPTIONS request not to reach the wrapped handler")
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin: %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Fatalf("expected Access-Control-Allow-Credentials to be set")
+	}
+}
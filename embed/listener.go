@@ -0,0 +1,118 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/go-systemd/activation"
+	"github.com/soheilhy/cmux"
+)
+
+// ListenerFactory lets an embedder supply its own net.Listener for a
+// client-serving URL (e.g. a QUIC/HTTP3 listener) instead of the
+// TCP/Unix/systemd listeners NewClientListener knows how to build.
+type ListenerFactory func(lurl url.URL) (net.Listener, error)
+
+// MatchHandler pairs a cmux matcher with the server loop that should run
+// against the connections it claims. sctx.Matchers lets embedders layer in
+// protocols cmux doesn't know about out of the box -- PROXY protocol v2,
+// a pre-read health probe, or a raw TCP admin channel -- ahead of the
+// built-in HTTP2/HTTP1/Any matchers. Matchers are tried in order, so more
+// specific matchers must be registered before more general ones.
+type MatchHandler struct {
+	Matcher cmux.Matcher
+	Serve   func(net.Listener) error
+}
+
+// NewClientListener builds the net.Listener for lurl. It understands the
+// "unix" (including Linux abstract-namespace paths, written as
+// "unix://@name"), "unixs" (the same, wrapped in TLS using tlsinfo),
+// "systemd:" (socket activation via LISTEN_FDS, with the host component
+// naming the socket), and "tcp+tls" (plain TCP wrapped in TLS using
+// tlsinfo) schemes in addition to plain TCP. tlsinfo may be nil if none of
+// the TLS-wrapping schemes are used. If factory is non-nil it is consulted
+// first, so embedders can override or add schemes of their own.
+func NewClientListener(lurl url.URL, tlsinfo *transport.TLSInfo, factory ListenerFactory) (net.Listener, error) {
+	if factory != nil {
+		if l, err := factory(lurl); err != nil {
+			return nil, err
+		} else if l != nil {
+			return l, nil
+		}
+	}
+
+	switch lurl.Scheme {
+	case "unix":
+		return net.Listen("unix", unixSocketAddr(lurl))
+	case "unixs":
+		l, err := net.Listen("unix", unixSocketAddr(lurl))
+		if err != nil {
+			return nil, err
+		}
+		return wrapTLSListener(l, tlsinfo)
+	case "systemd":
+		name := lurl.Host
+		listeners, err := activation.ListenersWithNames()
+		if err != nil {
+			return nil, err
+		}
+		ls, ok := listeners[name]
+		if !ok || len(ls) == 0 {
+			return nil, fmt.Errorf("embed: no systemd socket named %q in LISTEN_FDNAMES", name)
+		}
+		return ls[0], nil
+	case "tcp", "":
+		return net.Listen("tcp", lurl.Host)
+	case "tcp+tls":
+		l, err := net.Listen("tcp", lurl.Host)
+		if err != nil {
+			return nil, err
+		}
+		return wrapTLSListener(l, tlsinfo)
+	default:
+		return nil, fmt.Errorf("embed: unsupported listener scheme %q", lurl.Scheme)
+	}
+}
+
+// unixSocketAddr resolves a "unix"/"unixs" URL to the path net.Listen
+// expects, translating the documented "unix://@name" abstract-namespace
+// syntax to the Linux abstract-namespace NUL prefix. net/url parses the
+// "@" in that syntax as an empty-userinfo delimiter, not as part of
+// Host, so the "@" never survives as a literal prefix on lurl.Host --
+// its presence is instead signaled by a non-nil lurl.User (with an
+// empty username), which is what we check for here.
+func unixSocketAddr(lurl url.URL) string {
+	addr := lurl.Host + lurl.Path
+	if lurl.User != nil {
+		return "\x00" + addr
+	}
+	return addr
+}
+
+// wrapTLSListener wraps l so that it terminates TLS using tlsinfo at accept
+// time, for listener URLs ("unixs://", "tcp+tls://") that should be secure
+// independent of sctx.secure.
+func wrapTLSListener(l net.Listener, tlsinfo *transport.TLSInfo) (net.Listener, error) {
+	cfg, err := tlsinfo.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, cfg), nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/coreos/etcd/pkg/transport"
+)
+
+func TestUnixSocketAddr(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"unix://@etcd.sock", "\x00etcd.sock"},
+		{"unix:///var/run/etcd.sock", "/var/run/etcd.sock"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.raw)
+		if err != nil {
+			t.Fatalf("url.Parse(%q): %v", tt.raw, err)
+		}
+		if got := unixSocketAddr(*u); got != tt.want {
+			t.Errorf("unixSocketAddr(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+// TestNewClientListenerTCPTLSWrapsTLS verifies that a "tcp+tls://" listener
+// URL is wrapped in TLS rather than falling through to the "unsupported
+// scheme" error.
+func TestNewClientListenerTCPTLSWrapsTLS(t *testing.T) {
+	u, err := url.Parse("tcp+tls://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	// No valid tlsinfo is configured here, so ServerConfig() is expected to
+	// fail -- the point of this test is that the scheme is recognized and
+	// reaches TLS wrapping instead of "embed: unsupported listener scheme".
+	_, err = NewClientListener(*u, &transport.TLSInfo{}, nil)
+	if err == nil {
+		t.Fatalf("expected an error from an empty TLSInfo, got nil")
+	}
+	if err.Error() == `embed: unsupported listener scheme "tcp+tls"` {
+		t.Fatalf("tcp+tls scheme was not recognized: %v", err)
+	}
+}
+
+func TestNewClientListenerUnsupportedScheme(t *testing.T) {
+	u, err := url.Parse("quic://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	_, err = NewClientListener(*u, nil, nil)
+	if err == nil {
+		t.Fatalf("expected an error for an unsupported scheme")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics registered here are served on the existing /metrics handler,
+// since they go through the default Prometheus registry like the rest of
+// etcd's metrics.
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "etcd",
+		Subsystem: "grpc",
+		Name:      "requests_duration_seconds",
+		Help:      "Latency of client-serving gRPC requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"method", "code"})
+
+	rpcTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "Total number of client-serving gRPC requests, by method and status code.",
+	}, []string{"method", "code"})
+
+	gatewayDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "etcd",
+		Subsystem: "gateway",
+		Name:      "requests_duration_seconds",
+		Help:      "Latency of HTTP/JSON gateway requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path", "code"})
+
+	gatewayTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "gateway",
+		Name:      "requests_total",
+		Help:      "Total number of HTTP/JSON gateway requests, by path and status code.",
+	}, []string{"path", "code"})
+
+	activeWatchStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "etcd",
+		Subsystem: "grpc",
+		Name:      "active_watch_streams",
+		Help:      "Number of currently open Watch streams on the client-serving gRPC server.",
+	})
+
+	bytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "network",
+		Name:      "client_bytes_received_total",
+		Help:      "Bytes received from clients, by serving protocol.",
+	}, []string{"proto"})
+
+	bytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcd",
+		Subsystem: "network",
+		Name:      "client_bytes_sent_total",
+		Help:      "Bytes sent to clients, by serving protocol.",
+	}, []string{"proto"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcDuration, rpcTotal, gatewayDuration, gatewayTotal, activeWatchStreams, bytesIn, bytesOut)
+}
+
+// metricsUnaryInterceptor records rpcDuration/rpcTotal for every unary RPC.
+func metricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, err, time.Since(start))
+	return resp, err
+}
+
+// metricsStreamInterceptor records rpcDuration/rpcTotal for every streaming
+// RPC, plus activeWatchStreams for Watch streams specifically.
+func metricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	if strings.Contains(info.FullMethod, "Watch") {
+		activeWatchStreams.Inc()
+		defer activeWatchStreams.Dec()
+	}
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, err, time.Since(start))
+	return err
+}
+
+func observeRPC(method string, err error, d time.Duration) {
+	code := status.Code(err).String()
+	rpcDuration.WithLabelValues(method, code).Observe(d.Seconds())
+	rpcTotal.WithLabelValues(method, code).Inc()
+}
+
+// observeGateway records gatewayDuration/gatewayTotal for an HTTP/JSON
+// gateway request.
+func observeGateway(path string, code int, d time.Duration) {
+	c := strconv.Itoa(code)
+	gatewayDuration.WithLabelValues(path, c).Observe(d.Seconds())
+	gatewayTotal.WithLabelValues(path, c).Inc()
+}
@@ -0,0 +1,306 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Middleware bundles the optional gRPC interceptors that etcd installs on
+// both the insecure and secure gRPC servers. Embedders set the fields they
+// need before starting etcd via embed.Config.Middleware; unset fields are
+// no-ops. Interceptors run in a fixed order (auth, then rate limiting, then
+// tracing) so that later interceptors can act on the resolved identity.
+type Middleware struct {
+	RateLimiter *RateLimiterConfig
+	Tracer      opentracing.Tracer
+	Auth        *AuthHook
+}
+
+// authInterceptors returns just m.Auth's interceptors, or nils if m has no
+// Auth configured. interceptorOpts hoists these ahead of metrics/access-log
+// so that logger sees the identity auth resolves, while leaving rate
+// limiting and tracing (which must themselves be observed by metrics and
+// the access log) in their normal position later in the chain.
+func (m *Middleware) authInterceptors() (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	if m == nil || m.Auth == nil {
+		return nil, nil
+	}
+	return m.Auth.unaryInterceptor, m.Auth.streamInterceptor
+}
+
+// nonAuthInterceptors returns the rate-limiting and tracing interceptors
+// implied by m, in that fixed order, without m.Auth's (see
+// authInterceptors).
+func (m *Middleware) nonAuthInterceptors() ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor) {
+	if m == nil {
+		return nil, nil
+	}
+	var u []grpc.UnaryServerInterceptor
+	var s []grpc.StreamServerInterceptor
+	if m.RateLimiter != nil {
+		rl := newRateLimiter(m.RateLimiter)
+		u = append(u, rl.unaryInterceptor)
+		s = append(s, rl.streamInterceptor)
+	}
+	if m.Tracer != nil {
+		t := &tracingInterceptor{tracer: m.Tracer}
+		u = append(u, t.unaryInterceptor)
+		s = append(s, t.streamInterceptor)
+	}
+	return u, s
+}
+
+// chainUnaryInterceptors composes is into a single interceptor, invoked in
+// order, since grpc.Server only accepts one grpc.UnaryInterceptor option.
+func chainUnaryInterceptors(is []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(is) - 1; i >= 0; i-- {
+			ic, next := is[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return ic(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// chainStreamInterceptors composes is into a single interceptor, invoked in
+// order, since grpc.Server only accepts one grpc.StreamInterceptor option.
+func chainStreamInterceptors(is []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		chained := handler
+		for i := len(is) - 1; i >= 0; i-- {
+			ic, next := is[i], chained
+			chained = func(srv interface{}, ss grpc.ServerStream) error {
+				return ic(srv, ss, info, next)
+			}
+		}
+		return chained(srv, ss)
+	}
+}
+
+// RateLimiterConfig configures the token-bucket rate limiter installed as a
+// gRPC interceptor. The per-method and per-client buckets are independent; a
+// request must pass both to proceed. A zero Rate disables the corresponding
+// bucket.
+type RateLimiterConfig struct {
+	// Rate is the sustained requests-per-second limit applied per method.
+	Rate float64
+	// Burst is the maximum burst size for the per-method bucket.
+	Burst int
+	// ClientRate and ClientBurst configure an additional bucket keyed by
+	// peer identity (see AuthHook), so no single client can exhaust the
+	// per-method budget on its own.
+	ClientRate  float64
+	ClientBurst int
+}
+
+type rateLimiter struct {
+	cfg *RateLimiterConfig
+
+	mu      sync.Mutex
+	methods map[string]*rate.Limiter
+	clients map[string]*rate.Limiter
+}
+
+func newRateLimiter(cfg *RateLimiterConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:     cfg,
+		methods: make(map[string]*rate.Limiter),
+		clients: make(map[string]*rate.Limiter),
+	}
+}
+
+func (rl *rateLimiter) allow(ctx context.Context, method string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.cfg.Rate > 0 {
+		lim, ok := rl.methods[method]
+		if !ok {
+			lim = rate.NewLimiter(rate.Limit(rl.cfg.Rate), rl.cfg.Burst)
+			rl.methods[method] = lim
+		}
+		if !lim.Allow() {
+			return false
+		}
+	}
+	if rl.cfg.ClientRate > 0 {
+		id := identityFromContext(ctx)
+		lim, ok := rl.clients[id]
+		if !ok {
+			lim = rate.NewLimiter(rate.Limit(rl.cfg.ClientRate), rl.cfg.ClientBurst)
+			rl.clients[id] = lim
+		}
+		if !lim.Allow() {
+			return false
+		}
+	}
+	return true
+}
+
+func (rl *rateLimiter) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !rl.allow(ctx, info.FullMethod) {
+		return nil, status.Error(codes.ResourceExhausted, "etcdserver: too many requests")
+	}
+	return handler(ctx, req)
+}
+
+func (rl *rateLimiter) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !rl.allow(ss.Context(), info.FullMethod) {
+		return status.Error(codes.ResourceExhausted, "etcdserver: too many requests")
+	}
+	return handler(srv, ss)
+}
+
+// AuthHook resolves a caller identity from an incoming RPC and stores it on
+// the context, where the per-client rate limiter and the access log read
+// it. The identity is kept under a key private to this package; it is not
+// passed to etcd's auth subsystem, which authorizes requests as before.
+type AuthHook struct {
+	// Extract returns the identity for ctx, or an error to reject the
+	// call outright. The default, when nil, returns the Subject CommonName
+	// of the client's leaf certificate, falling back to "" for insecure
+	// connections.
+	Extract func(ctx context.Context) (string, error)
+}
+
+type identityKey struct{}
+
+func identityFromContext(ctx context.Context) string {
+	if v, ok := ctx.Value(identityKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
+
+func (h *AuthHook) extract(ctx context.Context) (string, error) {
+	if h.Extract != nil {
+		return h.Extract(ctx)
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return "", nil
+	}
+	return tlsInfo.State.PeerCertificates[0].Subject.CommonName, nil
+}
+
+func (h *AuthHook) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id, err := h.extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, identityKey{}, id), req)
+}
+
+func (h *AuthHook) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id, err := h.extract(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &identityServerStream{ServerStream: ss, id: id})
+}
+
+type identityServerStream struct {
+	grpc.ServerStream
+	id string
+}
+
+func (s *identityServerStream) Context() context.Context {
+	return context.WithValue(s.ServerStream.Context(), identityKey{}, s.id)
+}
+
+// tracingInterceptor starts a span for each RPC, picking up an existing
+// trace from grpc-trace-bin or W3C traceparent metadata when present.
+type tracingInterceptor struct {
+	tracer opentracing.Tracer
+}
+
+func spanContextFromMD(tracer opentracing.Tracer, ctx context.Context) opentracing.SpanContext {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	carrier := make(opentracing.TextMapCarrier, len(md))
+	for k, v := range md {
+		if len(v) > 0 {
+			carrier[k] = v[0]
+		}
+	}
+	sc, _ := tracer.Extract(opentracing.TextMap, carrier)
+	return sc
+}
+
+func (t *tracingInterceptor) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	parent := spanContextFromMD(t.tracer, ctx)
+	span := t.tracer.StartSpan(info.FullMethod, ext.RPCServerOption(parent))
+	defer span.Finish()
+	resp, err := handler(opentracing.ContextWithSpan(ctx, span), req)
+	if err != nil {
+		ext.Error.Set(span, true)
+	}
+	return resp, err
+}
+
+func (t *tracingInterceptor) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	spanCtx := opentracing.ContextWithSpan(ss.Context(), t.tracer.StartSpan(info.FullMethod, ext.RPCServerOption(spanContextFromMD(t.tracer, ss.Context()))))
+	span := opentracing.SpanFromContext(spanCtx)
+	defer span.Finish()
+	err := handler(srv, &tracingServerStream{ServerStream: ss, ctx: spanCtx})
+	if err != nil {
+		ext.Error.Set(span, true)
+	}
+	return err
+}
+
+type tracingServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracingServerStream) Context() context.Context { return s.ctx }
+
+// forwardHeaders propagates the headers that the interceptor chain cares
+// about (auth bearer tokens and trace context) from the HTTP/JSON gateway
+// request into the outgoing gRPC metadata, so that REST calls go through
+// the same auth, rate-limiting, and tracing interceptors as native gRPC
+// calls.
+func forwardHeaders(ctx context.Context, r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for _, h := range []string{"Authorization", "grpc-trace-bin", "traceparent", "tracestate"} {
+		if v := r.Header.Get(h); v != "" {
+			md.Set(strings.ToLower(h), v)
+		}
+	}
+	return md
+}
@@ -16,6 +16,7 @@ package embed
 
 import (
 	"context"
+	"crypto/tls"
 	"io/ioutil"
 	defaultLog "log"
 	"net"
@@ -37,6 +38,7 @@ import (
 	"github.com/coreos/etcd/pkg/transport"
 
 	gw "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
 	"github.com/soheilhy/cmux"
 	"github.com/tmc/grpc-websocket-proxy/wsproxy"
 	"golang.org/x/net/trace"
@@ -56,20 +58,62 @@ type serveCtx struct {
 	userHandlers    map[string]http.Handler
 	serviceRegister func(*grpc.Server)
 
+	// Mw, UnaryInterceptors, and StreamInterceptors compose the gRPC
+	// interceptor chain installed on both the insecure and secure
+	// servers. Mw's interceptors run before any additional interceptors an
+	// embedder supplies directly; see interceptorOpts for the full order.
+	Mw                 *Middleware
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+
+	// GatewayOptions configures the HTTP/JSON gateway mux built in
+	// registerGateway (custom marshalers, header matchers).
+	GatewayOptions GatewayOptions
+
+	// CORS configures preflight handling for the gRPC-Web/Connect
+	// endpoints exposed alongside the native gRPC and gateway ones.
+	CORS CORSOptions
+
+	// Matchers are tried, in order, ahead of cmux's built-in HTTP2/HTTP1/Any
+	// matchers, so embedders can layer extra protocols onto sctx.l (see
+	// MatchHandler).
+	Matchers []MatchHandler
+
+	// ListenerFactory, when set, is consulted by NewClientListener before
+	// falling back to etcd's own TCP/Unix/systemd listener construction,
+	// so embedders can bring their own net.Listener (e.g. QUIC/HTTP3).
+	ListenerFactory ListenerFactory
+
+	// TLS configures SNI-based multi-cert serving, on-disk cert reload,
+	// and ACME issuance for the secure listener. It is shared by the
+	// secure HTTP server and the gRPC server so both see the same
+	// rotating *tls.Config.
+	TLS    TLSManagerConfig
+	tlsMgr *tlsManager
+
+	// AccessLog configures the structured access log and byte-count
+	// metrics emitted for every gRPC RPC and gateway HTTP request.
+	AccessLog AccessLogConfig
+	accessLog *accessLogger
+
 	secureHTTPServer    *http.Server
 	secureGrpcServerC   chan *grpc.Server
 	insecureGrpcServerC chan *grpc.Server
 }
 
-func newServeCtx() *serveCtx {
+// newServeCtx builds a serveCtx, copying cfg's exported knobs onto it. cfg
+// may be nil, in which case every knob keeps its zero value.
+func newServeCtx(cfg *Config) *serveCtx {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &serveCtx{
+	sctx := &serveCtx{
 		ctx:                 ctx,
 		cancel:              cancel,
 		userHandlers:        make(map[string]http.Handler),
 		secureGrpcServerC:   make(chan *grpc.Server, 1),
 		insecureGrpcServerC: make(chan *grpc.Server, 1),
 	}
+	cfg.apply(sctx)
+	return sctx
 }
 
 // serve accepts incoming connections on the listener l,
@@ -85,13 +129,32 @@ func (sctx *serveCtx) serve(
 	<-s.ReadyNotify()
 	plog.Info("ready to serve client requests")
 
+	unaryInterceptor, streamInterceptor, interceptorOpts := sctx.interceptorOpts()
+	gopts = append(gopts, interceptorOpts...)
+
 	m := cmux.New(sctx.l)
+	for _, mh := range sctx.Matchers {
+		ml := m.Match(mh.Matcher)
+		go func(mh MatchHandler, ml net.Listener) { errHandler(mh.Serve(ml)) }(mh, ml)
+	}
+
 	v3c := v3client.New(s)
 	servElection := v3election.NewElectionServer(v3c)
 	servLock := v3lock.NewLockServer(v3c)
 
+	if sctx.secure {
+		tlsMgr, err := newTLSManager(tlsinfo, sctx.TLS)
+		if err != nil {
+			return err
+		}
+		sctx.tlsMgr = tlsMgr
+		if h := tlsMgr.acmeHTTPHandler(); h != nil {
+			sctx.registerUserHandler(acmeChallengePath, h)
+		}
+	}
+
 	if sctx.insecure {
-		gs := v3rpc.Server(s, nil, gopts...)
+		gs := v3rpc.Server(s, nil, unaryInterceptor, streamInterceptor, gopts...)
 		sctx.insecureGrpcServerC <- gs
 		v3electionpb.RegisterElectionServer(gs, servElection)
 		v3lockpb.RegisterLockServer(gs, servLock)
@@ -110,9 +173,10 @@ func (sctx *serveCtx) serve(
 		}
 
 		httpmux := sctx.createMux(gwmux, handler)
+		webgs := newGRPCWebWrapper(gs, sctx.CORS)
 
 		srvhttp := &http.Server{
-			Handler:  wrapMux(httpmux),
+			Handler:  sctx.accessLog.httpAccessLog(corsHandler(sctx.CORS, grpcHandlerFunc(gs, webgs, wrapMux(httpmux)))),
 			ErrorLog: logger, // do not log user error
 		}
 		httpl := m.Match(cmux.HTTP1())
@@ -121,18 +185,19 @@ func (sctx *serveCtx) serve(
 	}
 
 	if sctx.secure {
-		tlscfg, tlsErr := tlsinfo.ServerConfig()
+		tlscfg, tlsErr := sctx.tlsMgr.config()
 		if tlsErr != nil {
 			return tlsErr
 		}
-		gs := v3rpc.Server(s, tlscfg, gopts...)
+		gs := v3rpc.Server(s, tlscfg, unaryInterceptor, streamInterceptor, gopts...)
 		sctx.secureGrpcServerC <- gs
 		v3electionpb.RegisterElectionServer(gs, servElection)
 		v3lockpb.RegisterLockServer(gs, servLock)
 		if sctx.serviceRegister != nil {
 			sctx.serviceRegister(gs)
 		}
-		handler = grpcHandlerFunc(gs, handler)
+		webgs := newGRPCWebWrapper(gs, sctx.CORS)
+		handler = corsHandler(sctx.CORS, grpcHandlerFunc(gs, webgs, handler))
 
 		dtls := tlscfg.Clone()
 		// trust local server
@@ -144,15 +209,14 @@ func (sctx *serveCtx) serve(
 			return err
 		}
 
-		tlsl, lerr := transport.NewTLSListener(m.Match(cmux.Any()), tlsinfo)
-		if lerr != nil {
-			return lerr
-		}
+		// Use tlscfg directly, rather than transport.NewTLSListener, so that
+		// sctx.tlsMgr's GetCertificate (rotation, SNI) applies here too.
+		tlsl := tls.NewListener(m.Match(cmux.Any()), tlscfg)
 		// TODO: add debug flag; enable logging when debug flag is set
 		httpmux := sctx.createMux(gwmux, handler)
 
 		srv := &http.Server{
-			Handler:   wrapMux(httpmux),
+			Handler:   sctx.accessLog.httpAccessLog(wrapMux(httpmux)),
 			TLSConfig: tlscfg,
 			ErrorLog:  logger, // do not log user error
 		}
@@ -167,19 +231,65 @@ func (sctx *serveCtx) serve(
 	return m.Serve()
 }
 
-// grpcHandlerFunc returns an http.Handler that delegates to grpcServer on incoming gRPC
-// connections or otherHandler otherwise. Given in gRPC docs.
-func grpcHandlerFunc(grpcServer *grpc.Server, otherHandler http.Handler) http.Handler {
-	if otherHandler == nil {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			grpcServer.ServeHTTP(w, r)
-		})
+// interceptorOpts builds the combined unary/stream interceptor sctx wants
+// installed, plus any interceptor-independent ServerOptions, for the
+// caller to hand to v3rpc.Server.
+//
+// v3rpc.Server already installs its own grpc.UnaryInterceptor/
+// StreamInterceptor to wire in etcd's own auth/quota interceptors, and
+// grpc.Server in this vintage panics if that ServerOption is set twice
+// (see chainUnaryInterceptors' doc comment) -- so this embed-level chain
+// cannot ride along as another grpc.UnaryInterceptor/StreamInterceptor
+// inside gopts. Instead v3rpc.Server takes it as an explicit interceptor
+// argument and appends it to its own internal chain, the same composition
+// point etcd already exposes for this purpose.
+//
+// sctx.Mw's auth interceptor runs before the access-log/metrics ones so
+// that the peer identity it injects into the context is visible by the
+// time they run -- a derived context only flows forward to whatever
+// receives it, so an interceptor can only observe identity set by
+// something earlier in the chain, never later. Rate limiting and tracing
+// stay after access-log/metrics (their normal position), so throttled and
+// traced requests are still counted and logged rather than skipping both
+// on a rejection.
+func (sctx *serveCtx) interceptorOpts() (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor, []grpc.ServerOption) {
+	sctx.accessLog = newAccessLogger(sctx.AccessLog)
+
+	authU, authS := sctx.Mw.authInterceptors()
+	var uics []grpc.UnaryServerInterceptor
+	var sics []grpc.StreamServerInterceptor
+	if authU != nil {
+		uics = append(uics, authU)
+		sics = append(sics, authS)
+	}
+	uics = append(uics, metricsUnaryInterceptor, sctx.accessLog.unaryInterceptor)
+	sics = append(sics, metricsStreamInterceptor, sctx.accessLog.streamInterceptor)
+	restU, restS := sctx.Mw.nonAuthInterceptors()
+	uics = append(uics, restU...)
+	sics = append(sics, restS...)
+	uics = append(uics, sctx.UnaryInterceptors...)
+	sics = append(sics, sctx.StreamInterceptors...)
+
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(grpcByteStatsHandler{}),
 	}
+	return chainUnaryInterceptors(uics), chainStreamInterceptors(sics), opts
+}
+
+// grpcHandlerFunc returns an http.Handler that delegates to grpcServer on incoming gRPC
+// connections, to webServer on gRPC-Web/Connect connections, or otherHandler
+// otherwise. Given in gRPC docs.
+func grpcHandlerFunc(grpcServer *grpc.Server, webServer *grpcweb.WrappedGrpcServer, otherHandler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
+		switch {
+		case webServer != nil && isGRPCWebOrConnect(r):
+			webServer.ServeHTTP(w, r)
+		case r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc"):
 			grpcServer.ServeHTTP(w, r)
-		} else {
+		case otherHandler != nil:
 			otherHandler.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
 		}
 	})
 }
@@ -192,7 +302,12 @@ func (sctx *serveCtx) registerGateway(opts []grpc.DialOption) (*gw.ServeMux, err
 	if err != nil {
 		return nil, err
 	}
-	gwmux := gw.NewServeMux()
+	// Forward auth and trace headers from the gateway request so that
+	// HTTP/JSON requests go through the same interceptor chain as native
+	// gRPC calls, then layer in the marshalers and any user-supplied
+	// ServeMuxOptions.
+	muxOpts := append([]gw.ServeMuxOption{gw.WithMetadata(forwardHeaders)}, defaultGatewayMuxOptions(sctx.GatewayOptions)...)
+	gwmux := gw.NewServeMux(muxOpts...)
 
 	handlers := []registerHandlerFunc{
 		etcdservergw.RegisterKVHandler,
@@ -227,7 +342,7 @@ func (sctx *serveCtx) createMux(gwmux *gw.ServeMux, handler http.Handler) *http.
 
 	httpmux.Handle(
 		"/v3beta/",
-		wsproxy.WebsocketProxy(
+		fieldMaskFilter(wsproxy.WebsocketProxy(
 			gwmux,
 			wsproxy.WithRequestMutator(
 				// Default to the POST method for streams
@@ -236,7 +351,7 @@ func (sctx *serveCtx) createMux(gwmux *gw.ServeMux, handler http.Handler) *http.
 					return outgoing
 				},
 			),
-		),
+		)),
 	)
 	if handler != nil {
 		httpmux.Handle("/", handler)
@@ -292,6 +407,10 @@ func teardownServeCtx(sctx *serveCtx, timeout time.Duration) {
 		stopInsecureServer(gs, timeout)
 	}
 
+	if sctx.tlsMgr != nil {
+		sctx.tlsMgr.Close()
+	}
+
 	// Close any open gRPC connections
 	sctx.cancel()
 }
@@ -0,0 +1,286 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// SNIHost pairs a server name with the certificate that should be
+// presented for it, and an optional client-CA so that a single listener
+// can terminate multiple virtual hosts with distinct client-auth policies:
+// a host with TrustedCAFile set requires and verifies a client certificate
+// signed by that CA; a host without one inherits the listener's base
+// client-auth policy.
+type SNIHost struct {
+	Host          string
+	CertFile      string
+	KeyFile       string
+	TrustedCAFile string
+}
+
+// TLSManagerConfig configures the tlsManager shared by the secure HTTP and
+// gRPC servers on a serveCtx.
+type TLSManagerConfig struct {
+	// SNIHosts serves a distinct certificate (and, optionally, client-CA)
+	// per hostname on the same listener.
+	SNIHosts []SNIHost
+	// ReloadInterval is the periodic stat-based fallback used to detect
+	// certificate rotation when fsnotify misses an event (e.g. NFS).
+	// Defaults to 1 minute.
+	ReloadInterval time.Duration
+	// ACMEHosts, when non-empty, fetches and renews certificates for the
+	// listed hostnames via ACME (Let's Encrypt-style) instead of (or in
+	// addition to) files on disk.
+	ACMEHosts []string
+	// ACMECacheDir persists ACME account and certificate data across
+	// restarts.
+	ACMECacheDir string
+}
+
+// tlsManager watches the configured certificate files for changes and
+// serves the right certificate for a given SNI host, so that rotating a
+// certificate no longer requires a restart. The set of SNI hosts is fixed
+// when the manager is created.
+type tlsManager struct {
+	base *transport.TLSInfo
+
+	mu        sync.RWMutex
+	certs     map[string]*tls.Certificate // "" is the default/base entry
+	clientCAs map[string]*x509.CertPool   // per-SNI-host client-auth, keyed by Host
+
+	acme *autocert.Manager
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func newTLSManager(tlsinfo *transport.TLSInfo, cfg TLSManagerConfig) (*tlsManager, error) {
+	m := &tlsManager{
+		base:      tlsinfo,
+		certs:     make(map[string]*tls.Certificate),
+		clientCAs: make(map[string]*x509.CertPool),
+		done:      make(chan struct{}),
+	}
+	if err := m.loadBase(); err != nil {
+		return nil, err
+	}
+	for _, h := range cfg.SNIHosts {
+		if err := m.loadSNIHost(h); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.ACMEHosts) > 0 {
+		m.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+		}
+		if cfg.ACMECacheDir != "" {
+			m.acme.Cache = autocert.DirCache(cfg.ACMECacheDir)
+		}
+	}
+
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = time.Minute
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	m.watcher = watcher
+	for _, f := range m.watchedFiles(tlsinfo, cfg.SNIHosts) {
+		if err := watcher.Add(f); err != nil {
+			plog.Warningf("failed to watch TLS file %s for changes: %v", f, err)
+		}
+	}
+	go m.watch(tlsinfo, cfg)
+
+	return m, nil
+}
+
+func (m *tlsManager) watchedFiles(tlsinfo *transport.TLSInfo, sni []SNIHost) []string {
+	files := []string{tlsinfo.CertFile, tlsinfo.KeyFile}
+	for _, h := range sni {
+		files = append(files, h.CertFile, h.KeyFile)
+	}
+	return files
+}
+
+func (m *tlsManager) loadBase() error {
+	cert, err := tls.LoadX509KeyPair(m.base.CertFile, m.base.KeyFile)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.certs[""] = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *tlsManager) loadSNIHost(h SNIHost) error {
+	cert, err := tls.LoadX509KeyPair(h.CertFile, h.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if h.TrustedCAFile != "" {
+		pool, err = loadCertPool(h.TrustedCAFile)
+		if err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.certs[h.Host] = &cert
+	if pool != nil {
+		m.clientCAs[h.Host] = pool
+	} else {
+		delete(m.clientCAs, h.Host)
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// loadCertPool reads the PEM-encoded certificates in file into a fresh
+// x509.CertPool for use as a per-host tls.Config.ClientCAs.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("embed: no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// watch reloads certificates on fsnotify events and, as a fallback for
+// filesystems that don't support it, on a periodic timer.
+func (m *tlsManager) watch(tlsinfo *transport.TLSInfo, cfg TLSManagerConfig) {
+	ticker := time.NewTicker(cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case ev, ok := <-m.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+				m.reload(tlsinfo, cfg.SNIHosts)
+			}
+		case <-ticker.C:
+			m.reload(tlsinfo, cfg.SNIHosts)
+		}
+	}
+}
+
+func (m *tlsManager) reload(tlsinfo *transport.TLSInfo, sni []SNIHost) {
+	if err := m.loadBase(); err != nil {
+		plog.Warningf("failed to reload TLS certificate %s: %v", m.base.CertFile, err)
+	}
+	for _, h := range sni {
+		if err := m.loadSNIHost(h); err != nil {
+			plog.Warningf("failed to reload TLS certificate for %s: %v", h.Host, err)
+		}
+	}
+}
+
+// getCertificate serves the certificate registered for hello.ServerName,
+// falling back to ACME and then to the default certificate.
+func (m *tlsManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	cert, ok := m.certs[hello.ServerName]
+	if !ok {
+		cert = m.certs[""]
+	}
+	m.mu.RUnlock()
+	if ok {
+		return cert, nil
+	}
+	if m.acme != nil {
+		if c, err := m.acme.GetCertificate(hello); err == nil {
+			return c, nil
+		}
+	}
+	return cert, nil
+}
+
+// config returns a *tls.Config that always dispatches through
+// getCertificate, so callers observe certificate rotation and SNI
+// selection without re-fetching the config, and through
+// getConfigForClient, so an SNI host with its own TrustedCAFile gets its
+// own client-auth policy instead of the listener's base one.
+func (m *tlsManager) config() (*tls.Config, error) {
+	cfg, err := m.base.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetCertificate = m.getCertificate
+	cfg.Certificates = nil
+	cfg.GetConfigForClient = m.getConfigForClient
+	return cfg, nil
+}
+
+// getConfigForClient returns a *tls.Config overriding ClientCAs and
+// ClientAuth for hello.ServerName when that host has its own
+// SNIHost.TrustedCAFile configured, so a single listener can require
+// distinct client certificates per virtual host. It returns nil for any
+// host without a configured client-CA, which tells the TLS stack to fall
+// back to the base *tls.Config unmodified.
+func (m *tlsManager) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	m.mu.RLock()
+	pool, ok := m.clientCAs[hello.ServerName]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	cfg, err := m.base.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetCertificate = m.getCertificate
+	cfg.Certificates = nil
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
+
+// acmeHTTPHandler returns the ACME HTTP-01 challenge handler, or nil if
+// ACME isn't configured.
+func (m *tlsManager) acmeHTTPHandler() http.Handler {
+	if m.acme == nil {
+		return nil
+	}
+	return m.acme.HTTPHandler(nil)
+}
+
+func (m *tlsManager) Close() {
+	close(m.done)
+	m.watcher.Close()
+}
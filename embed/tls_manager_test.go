@@ -0,0 +1,171 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+)
+
+// writeTestCAFile generates a throwaway self-signed CA certificate, PEM
+// encodes it to a temp file, and returns the file's path; the caller is
+// responsible for removing it.
+func writeTestCAFile(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Unix(0, 0).Add(100 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	f, err := ioutil.TempFile("", "tls-manager-test-ca")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatalf("pem.Encode: %v", err)
+	}
+	f.Close()
+	return f.Name()
+}
+
+// writeTestServerCertFiles generates a throwaway self-signed server
+// certificate and key, PEM encodes them to temp files, and returns their
+// paths; the caller is responsible for removing them.
+func writeTestServerCertFiles(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-server"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(100 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	cf, err := ioutil.TempFile("", "tls-manager-test-cert")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	if err := pem.Encode(cf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatalf("pem.Encode: %v", err)
+	}
+	cf.Close()
+
+	kf, err := ioutil.TempFile("", "tls-manager-test-key")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	if err := pem.Encode(kf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}); err != nil {
+		t.Fatalf("pem.Encode: %v", err)
+	}
+	kf.Close()
+
+	return cf.Name(), kf.Name()
+}
+
+// TestTLSManagerSNIClientAuth verifies that an SNIHost configured with a
+// TrustedCAFile gets a GetConfigForClient override requiring and
+// verifying client certificates against that host's CA, while a host
+// without one falls back to the base config unmodified.
+func TestTLSManagerSNIClientAuth(t *testing.T) {
+	caFile := writeTestCAFile(t)
+	defer os.Remove(caFile)
+
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		t.Fatalf("loadCertPool: %v", err)
+	}
+
+	certFile, keyFile := writeTestServerCertFiles(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	m := &tlsManager{
+		base:      &transport.TLSInfo{CertFile: certFile, KeyFile: keyFile},
+		certs:     map[string]*tls.Certificate{"": {}},
+		clientCAs: map[string]*x509.CertPool{"secure.example.com": pool},
+	}
+
+	cfg, err := m.getConfigForClient(&tls.ClientHelloInfo{ServerName: "secure.example.com"})
+	if err != nil {
+		t.Fatalf("getConfigForClient: %v", err)
+	}
+	if cfg == nil {
+		t.Fatalf("expected a non-nil *tls.Config for a host with a configured client-CA")
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want RequireAndVerifyClientCert", cfg.ClientAuth)
+	}
+	if cfg.ClientCAs != pool {
+		t.Errorf("ClientCAs was not set to the host's loaded CA pool")
+	}
+
+	cfg, err = m.getConfigForClient(&tls.ClientHelloInfo{ServerName: "plain.example.com"})
+	if err != nil {
+		t.Fatalf("getConfigForClient: %v", err)
+	}
+	if cfg != nil {
+		t.Errorf("expected nil *tls.Config for a host without a configured client-CA, got %+v", cfg)
+	}
+}
+
+func TestLoadCertPoolRejectsEmptyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "tls-manager-test-empty-ca")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	if _, err := loadCertPool(f.Name()); err == nil {
+		t.Fatalf("expected an error loading an empty CA file")
+	}
+}